@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// AdminServer exposes reprox's routing table, certificate status, and
+// Prometheus metrics over HTTP, and lets operators force a reconcile or a
+// single host's certificate renewal. It closes the black-box behavior
+// where failures only ever surfaced as fmt.Println to stdout.
+type AdminServer struct {
+	state       *State
+	certManager *CertManager
+	reconcile   func(ctx context.Context) error
+}
+
+// NewAdminServer wires the admin HTTP API to state, certManager, and a
+// reconcile function the /reload endpoint calls on demand.
+func NewAdminServer(state *State, certManager *CertManager, reconcile func(ctx context.Context) error) *AdminServer {
+	return &AdminServer{state: state, certManager: certManager, reconcile: reconcile}
+}
+
+// ListenAndServe binds addr and serves the admin API until ctx is done.
+func (a *AdminServer) ListenAndServe(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /routes", a.handleRoutes)
+	mux.HandleFunc("GET /certs", a.handleCerts)
+	mux.HandleFunc("POST /reload", a.handleReload)
+	mux.HandleFunc("POST /certs/{host}/renew", a.handleCertRenew)
+	mux.HandleFunc("GET /metrics", a.handleMetrics)
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("Error serving admin API: %w", err)
+	}
+	return nil
+}
+
+func (a *AdminServer) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.state.Routes())
+}
+
+func (a *AdminServer) handleCerts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.certManager.Certs())
+}
+
+func (a *AdminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := a.reconcile(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) handleCertRenew(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+	if host == "" {
+		http.Error(w, "missing host", http.StatusBadRequest)
+		return
+	}
+
+	err := a.certManager.EnsureCertificate(r.Context(), host)
+	a.state.RecordCertRenew(err == nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	routes := a.state.Routes()
+	renewSuccess, renewFail := a.state.CertRenewCounts()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP reprox_routes_total Number of routed hosts.")
+	fmt.Fprintln(w, "# TYPE reprox_routes_total gauge")
+	fmt.Fprintf(w, "reprox_routes_total %d\n", len(routes))
+
+	fmt.Fprintln(w, "# HELP reprox_reconcile_errors_total Reconcile attempts that failed.")
+	fmt.Fprintln(w, "# TYPE reprox_reconcile_errors_total counter")
+	fmt.Fprintf(w, "reprox_reconcile_errors_total %d\n", a.state.ReconcileErrors())
+
+	fmt.Fprintln(w, "# HELP reprox_cert_renewals_total Certificate renewal attempts by result.")
+	fmt.Fprintln(w, "# TYPE reprox_cert_renewals_total counter")
+	fmt.Fprintf(w, "reprox_cert_renewals_total{result=\"success\"} %d\n", renewSuccess)
+	fmt.Fprintf(w, "reprox_cert_renewals_total{result=\"fail\"} %d\n", renewFail)
+
+	fmt.Fprintln(w, "# HELP reprox_cert_expiry_seconds Seconds until each host's certificate expires.")
+	fmt.Fprintln(w, "# TYPE reprox_cert_expiry_seconds gauge")
+	for _, cert := range a.certManager.Certs() {
+		fmt.Fprintf(w, "reprox_cert_expiry_seconds{host=%q} %d\n", cert.Host, int64(time.Until(cert.NotAfter).Seconds()))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Aggregator merges routes from multiple Providers into one route table. It
+// lets reprox run outside pure-Docker environments by combining, say, the
+// Docker label provider with a file or Kubernetes one.
+type Aggregator struct {
+	// providers is in priority order: if two providers route the same host,
+	// the earlier one wins.
+	providers []Provider
+}
+
+// NewAggregator returns an Aggregator over providers, highest priority first.
+func NewAggregator(providers ...Provider) *Aggregator {
+	return &Aggregator{providers: providers}
+}
+
+// Watch emits the merged route table once at startup and again every time
+// any provider reports a change.
+func (a *Aggregator) Watch(ctx context.Context) <-chan []Route {
+	out := make(chan []Route)
+
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	for _, p := range a.providers {
+		go func(sub <-chan struct{}) {
+			for range sub {
+				notify()
+			}
+		}(p.Subscribe(ctx))
+	}
+
+	go func() {
+		defer close(out)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+				routes, err := a.merge(ctx)
+				if err != nil {
+					fmt.Println("Error merging routes:", err)
+					continue
+				}
+				select {
+				case out <- routes:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// merge collects Routes from every provider, keeping the first provider's
+// route whenever two providers (or two routes from the same provider)
+// disagree on the same host. A dropped duplicate is logged rather than
+// discarded silently, since the route it beat may be serving a completely
+// different backend than the one that won.
+func (a *Aggregator) merge(ctx context.Context) ([]Route, error) {
+	seen := map[string]bool{}
+	var merged []Route
+
+	for _, p := range a.providers {
+		routes, err := p.Routes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range routes {
+			if seen[route.Host] {
+				fmt.Println("Ignoring duplicate route for host", route.Host, "- a higher-priority provider or earlier rule already claimed it")
+				continue
+			}
+			seen[route.Host] = true
+			merged = append(merged, route)
+		}
+	}
+
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Host < merged[j].Host })
+	return merged, nil
+}
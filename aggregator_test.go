@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// fakeProvider is a Provider stub so Aggregator.merge's priority/conflict
+// logic can be exercised without a real Docker/file/Kubernetes backend.
+type fakeProvider struct {
+	routes []Route
+}
+
+func (f *fakeProvider) Routes(ctx context.Context) ([]Route, error) {
+	return f.routes, nil
+}
+
+func (f *fakeProvider) Subscribe(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+func TestAggregatorMergePrefersHigherPriorityProvider(t *testing.T) {
+	high := &fakeProvider{routes: []Route{
+		{Host: "shared.example.com", Upstream: Upstream{Name: "high"}},
+		{Host: "only-high.example.com", Upstream: Upstream{Name: "high"}},
+	}}
+	low := &fakeProvider{routes: []Route{
+		{Host: "shared.example.com", Upstream: Upstream{Name: "low"}},
+		{Host: "only-low.example.com", Upstream: Upstream{Name: "low"}},
+	}}
+
+	aggregator := NewAggregator(high, low)
+
+	merged, err := aggregator.merge(context.Background())
+	if err != nil {
+		t.Fatalf("merge() error = %v", err)
+	}
+	if len(merged) != 3 {
+		t.Fatalf("expected 3 merged routes, got %d: %+v", len(merged), merged)
+	}
+
+	byHost := make(map[string]Route, len(merged))
+	for _, route := range merged {
+		byHost[route.Host] = route
+	}
+
+	if got := byHost["shared.example.com"].Upstream.Name; got != "high" {
+		t.Errorf("shared.example.com Upstream.Name = %q, want the higher-priority provider to win", got)
+	}
+	if got := byHost["only-low.example.com"].Upstream.Name; got != "low" {
+		t.Errorf("only-low.example.com Upstream.Name = %q, want the only provider that routes it", got)
+	}
+}
+
+func TestAggregatorMergeSortsByHost(t *testing.T) {
+	provider := &fakeProvider{routes: []Route{
+		{Host: "b.example.com"},
+		{Host: "a.example.com"},
+	}}
+
+	merged, err := NewAggregator(provider).merge(context.Background())
+	if err != nil {
+		t.Fatalf("merge() error = %v", err)
+	}
+	if len(merged) != 2 || merged[0].Host != "a.example.com" || merged[1].Host != "b.example.com" {
+		t.Errorf("merge() = %+v, want routes sorted by host", merged)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certDir is where reprox stores its ACME account key and issued
+// certificates. Unlike the old /etc/letsencrypt layout this directory is
+// owned exclusively by reprox, so nothing else can race our writes.
+const certDir = "/var/lib/reprox/certs"
+
+// acmeChallengeAddr is where CertManager.ServeChallenges listens for
+// HTTP-01 challenge requests. It's loopback-only: the :80 server block in
+// configTemplate is what's actually reachable from the internet, and it
+// proxies /.well-known/acme-challenge/ here.
+const acmeChallengeAddr = "127.0.0.1:8402"
+
+// CertManager owns certificate issuance and renewal for every routed host.
+// It replaces the certbotRun/ensureCertificate subprocess dance: reprox now
+// speaks ACME directly to Let's Encrypt, keeps certificates in an in-memory
+// cache, and renews them in the background instead of racing nginx config
+// writes against a certbot invocation.
+type CertManager struct {
+	// manager is swapped atomically rather than mutated in place, since
+	// SetHosts (called from every reconcile and admin /reload) would
+	// otherwise race autocert.Manager's own unsynchronized reads of its
+	// HostPolicy field from EnsureCertificate/RenewLoop's goroutine.
+	manager atomic.Pointer[autocert.Manager]
+
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate // host -> leaf certificate, for the admin API
+}
+
+// CertInfo describes one host's certificate for the admin API's /certs
+// endpoint and the reprox_cert_expiry_seconds metric.
+type CertInfo struct {
+	Host       string
+	Issuer     string
+	NotAfter   time.Time
+	SelfSigned bool
+}
+
+// NewCertManager creates a CertManager that registers with Let's Encrypt
+// using email as the account contact and persists issued certificates
+// under certDir.
+func NewCertManager(email string) *CertManager {
+	cm := &CertManager{certs: map[string]*x509.Certificate{}}
+	cm.manager.Store(&autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(certDir),
+		Email:      email,
+		HostPolicy: autocert.HostWhitelist(),
+	})
+	return cm
+}
+
+// Certs returns the current certificate status of every host a certificate
+// has been issued for.
+func (cm *CertManager) Certs() []CertInfo {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	infos := make([]CertInfo, 0, len(cm.certs))
+	for host, cert := range cm.certs {
+		infos = append(infos, CertInfo{
+			Host:       host,
+			Issuer:     cert.Issuer.CommonName,
+			NotAfter:   cert.NotAfter,
+			SelfSigned: cert.CheckSignatureFrom(cert) == nil,
+		})
+	}
+	return infos
+}
+
+// SetHosts restricts certificate issuance to the given hosts. It is called
+// every time the route table changes (from the main reconcile loop and
+// concurrently from every admin /reload request) so that a newly routed
+// host becomes eligible for an ACME challenge immediately, and a removed
+// host stops being renewed. It builds a new autocert.Manager value with the
+// updated HostPolicy and swaps it in atomically rather than assigning the
+// field in place, since EnsureCertificate's goroutines read it via the
+// manager with no locking of their own.
+func (cm *CertManager) SetHosts(hosts []string) {
+	next := *cm.manager.Load()
+	next.HostPolicy = autocert.HostWhitelist(hosts...)
+	cm.manager.Store(&next)
+}
+
+// HTTPHandler returns the handler that answers HTTP-01 challenges. nginx
+// proxies /.well-known/acme-challenge/ to it instead of certbot rewriting
+// nginx's own config to serve the challenge. Each request is served by the
+// manager SetHosts most recently stored, so the host whitelist it checks is
+// the current one rather than the one in place when the handler was built.
+func (cm *CertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	cm.manager.Load().HTTPHandler(fallback)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm.manager.Load().HTTPHandler(fallback).ServeHTTP(w, r)
+	})
+}
+
+// TLSConfig returns a tls.Config whose GetCertificate pulls straight from
+// the in-memory cache, issuing or renewing on demand.
+func (cm *CertManager) TLSConfig() *tls.Config {
+	return cm.manager.Load().TLSConfig()
+}
+
+// ServeChallenges binds acmeChallengeAddr and answers HTTP-01 challenges
+// until ctx is done. nginx's :80 server block proxies
+// /.well-known/acme-challenge/ here; nothing else should ever reach it, so
+// any other request is rejected instead of falling through to a real
+// handler.
+func (cm *CertManager) ServeChallenges(ctx context.Context) error {
+	server := &http.Server{
+		Addr: acmeChallengeAddr,
+		Handler: cm.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		})),
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return errors.Join(errors.New("Error serving ACME challenges"), err)
+	}
+	return nil
+}
+
+// EnsureCertificate makes sure a certificate for host is issued and
+// exported to certDir/live/host/{fullchain,privkey}.pem so nginx can read
+// it, the same layout certbot used to produce.
+func (cm *CertManager) EnsureCertificate(ctx context.Context, host string) error {
+	cert, err := cm.manager.Load().GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+	if err != nil {
+		return errors.Join(fmt.Errorf("Error ensuring certificate for %s", host), err)
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return errors.Join(fmt.Errorf("Error parsing certificate for %s", host), err)
+		}
+	}
+	cm.mu.Lock()
+	cm.certs[host] = leaf
+	cm.mu.Unlock()
+
+	return writeCertFiles(host, cert)
+}
+
+func writeCertFiles(host string, cert *tls.Certificate) error {
+	dir := filepath.Join(certDir, "live", host)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Join(errors.New("Error creating certificate directory"), err)
+	}
+
+	var fullchain []byte
+	for _, der := range cert.Certificate {
+		fullchain = append(fullchain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "fullchain.pem"), fullchain, 0644); err != nil {
+		return errors.Join(errors.New("Error writing fullchain.pem"), err)
+	}
+
+	keyDER, err := marshalPrivateKey(cert.PrivateKey)
+	if err != nil {
+		return errors.Join(errors.New("Error marshaling private key"), err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, "privkey.pem"), keyPEM, 0600); err != nil {
+		return errors.Join(errors.New("Error writing privkey.pem"), err)
+	}
+
+	return nil
+}
+
+// marshalPrivateKey encodes the key types autocert can hand back
+// (RSA, ECDSA, Ed25519) to PKCS#8 DER so they can be PEM-wrapped uniformly.
+func marshalPrivateKey(key any) ([]byte, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return x509.MarshalPKCS8PrivateKey(key)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// renewCheckInterval is how often hosts are re-checked once renewal is
+// succeeding; renewBackoff/maxRenewBackoff govern how soon the next check
+// comes back around after a failure instead of waiting out the rest of
+// renewCheckInterval.
+const (
+	renewCheckInterval = 12 * time.Hour
+	renewBackoff       = 30 * time.Second
+	maxRenewBackoff    = 10 * time.Minute
+)
+
+// RenewLoop periodically re-checks every routed host's certificate so
+// renewal happens well before expiry instead of on the next incoming TLS
+// handshake. The timer driving the next check is renewCheckInterval while
+// renewals are succeeding; a failure resets it to backoff instead, which
+// then doubles (capped at maxRenewBackoff) until a check succeeds again,
+// mirroring the traefik ACME loader pattern.
+func (cm *CertManager) RenewLoop(ctx context.Context, hosts func() []string) {
+	backoff := renewBackoff
+
+	timer := time.NewTimer(renewCheckInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			failed := false
+			for _, host := range hosts() {
+				err := cm.EnsureCertificate(ctx, host)
+				state.RecordCertRenew(err == nil)
+				if err != nil {
+					fmt.Println("Error renewing certificate:", err)
+					failed = true
+				}
+			}
+
+			if failed {
+				timer.Reset(backoff)
+				backoff = min(backoff*2, maxRenewBackoff)
+			} else {
+				backoff = renewBackoff
+				timer.Reset(renewCheckInterval)
+			}
+		}
+	}
+}
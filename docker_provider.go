@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// debounceWindow coalesces bursts of container events (e.g. a compose stack
+// starting a dozen containers at once) into a single reconcile.
+const debounceWindow = 500 * time.Millisecond
+
+// pollFallback is the safety-net interval that reconciles routes even if the
+// event stream is missed or disconnects without us noticing.
+const pollFallback = 5 * time.Minute
+
+// eventReconnectDelay is how long Subscribe waits before re-opening the
+// Docker event stream after it closes, so a daemon that keeps failing to
+// connect doesn't spin the reconnect loop.
+const eventReconnectDelay = 1 * time.Second
+
+// DockerProvider discovers routes from reprox.* labels on running
+// containers, reacting to container lifecycle changes instead of the old
+// 30s poll that left up to a 30s window where a started container had no
+// route and a stopped one still dangled as an upstream.
+type DockerProvider struct {
+	client *client.Client
+}
+
+// NewDockerProvider returns a Provider backed by dockerClient.
+func NewDockerProvider(dockerClient *client.Client) *DockerProvider {
+	return &DockerProvider{client: dockerClient}
+}
+
+// Routes lists running containers and groups the ones carrying a
+// reprox.host label into one Route per host, so several containers can
+// share a host as upstream servers instead of the last one listed silently
+// overwriting the others.
+func (p *DockerProvider) Routes(ctx context.Context) ([]Route, error) {
+	containers, err := p.client.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing containers: %w", err)
+	}
+
+	byHost := map[string][]container.Summary{}
+	var hosts []string
+	for _, c := range containers {
+		if len(c.Names) == 0 {
+			continue
+		}
+		host, ok := c.Labels["reprox.host"]
+		if !ok || host == "" {
+			continue
+		}
+		if _, seen := byHost[host]; !seen {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], c)
+	}
+	sort.Strings(hosts)
+
+	var routes []Route
+	for _, host := range hosts {
+		routes = append(routes, buildRoute(host, byHost[host]))
+	}
+
+	return routes, nil
+}
+
+// buildRoute merges every container routed to host into a single Route: one
+// upstream server per container, load-balanced per the reprox.lb.* labels
+// read from the group's first container (sorted by name for determinism).
+func buildRoute(host string, containers []container.Summary) Route {
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Names[0] < containers[j].Names[0]
+	})
+
+	primary := containers[0].Labels
+
+	servers := make([]UpstreamServer, 0, len(containers))
+	for _, c := range containers {
+		servers = append(servers, UpstreamServer{
+			Address:     strings.TrimPrefix(c.Names[0], "/"),
+			MaxFails:    sanitizeMaxFails(c.Labels["reprox.lb.maxfails"]),
+			FailTimeout: sanitizeFailTimeout(c.Labels["reprox.lb.failtimeout"]),
+		})
+	}
+
+	return Route{
+		Host: host,
+		Upstream: Upstream{
+			Name:            upstreamName(host),
+			Strategy:        sanitizeStrategy(primary["reprox.lb.strategy"]),
+			HealthCheckPath: primary["reprox.healthcheck.path"],
+			Servers:         servers,
+		},
+		Middlewares: parseMiddlewares(primary),
+	}
+}
+
+// subscribeEvents opens the Docker event stream. Per the client's own
+// contract, if either channel delivers an error all processing stops and
+// both channels are closed; the caller must call subscribeEvents again to
+// resume receiving events.
+func (p *DockerProvider) subscribeEvents(ctx context.Context) (<-chan events.Message, <-chan error) {
+	eventFilters := filters.NewArgs(
+		filters.Arg("type", string(events.ContainerEventType)),
+		filters.Arg("event", "start"),
+		filters.Arg("event", "die"),
+		filters.Arg("event", "destroy"),
+		filters.Arg("event", "rename"),
+		filters.Arg("event", "health_status"),
+	)
+	return p.client.Events(ctx, events.ListOptions{Filters: eventFilters})
+}
+
+// Subscribe watches the Docker event stream for container lifecycle changes
+// relevant to routing, debounced so a burst of events triggers one
+// notification, and falls back to pollFallback so a missed or dropped event
+// stream can't wedge routing forever. It reopens the event stream itself
+// whenever the daemon connection drops, since the client stops delivering
+// on both channels after any error instead of recovering on its own.
+func (p *DockerProvider) Subscribe(ctx context.Context) <-chan struct{} {
+	out := make(chan struct{}, 1)
+
+	go func() {
+		defer close(out)
+
+		eventsCh, errCh := p.subscribeEvents(ctx)
+
+		notify := func() {
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+		}
+
+		// Notify once on startup so the first route table is available
+		// without waiting for an event or the fallback poll.
+		notify()
+
+		ticker := time.NewTicker(pollFallback)
+		defer ticker.Stop()
+
+		var debounce *time.Timer
+		debounceFired := make(chan struct{})
+
+		reconnect := func() {
+			select {
+			case <-time.After(eventReconnectDelay):
+			case <-ctx.Done():
+			}
+			eventsCh, errCh = p.subscribeEvents(ctx)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case evt, ok := <-eventsCh:
+				if !ok {
+					// the stream closed without a distinct error; reopen it.
+					reconnect()
+					continue
+				}
+				_ = evt
+				if debounce == nil {
+					debounce = time.AfterFunc(debounceWindow, func() {
+						select {
+						case debounceFired <- struct{}{}:
+						case <-ctx.Done():
+						}
+					})
+				} else {
+					debounce.Reset(debounceWindow)
+				}
+
+			case err, ok := <-errCh:
+				if ok && err != nil {
+					fmt.Println("Error watching Docker events:", err)
+				}
+				// the event stream died; reopen it instead of busy-looping
+				// on the now-closed channels, relying on the fallback poll
+				// in the meantime.
+				reconnect()
+
+			case <-debounceFired:
+				debounce = nil
+				notify()
+
+			case <-ticker.C:
+				notify()
+			}
+		}
+	}()
+
+	return out
+}
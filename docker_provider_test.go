@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestBuildRoute(t *testing.T) {
+	containers := []container.Summary{
+		{
+			Names: []string{"/app-2"},
+			Labels: map[string]string{
+				"reprox.host": "example.com",
+			},
+		},
+		{
+			Names: []string{"/app-1"},
+			Labels: map[string]string{
+				"reprox.host":           "example.com",
+				"reprox.lb.strategy":    "least_conn",
+				"reprox.lb.maxfails":    "3",
+				"reprox.lb.failtimeout": "30s",
+			},
+		},
+	}
+
+	route := buildRoute("example.com", containers)
+
+	if route.Host != "example.com" {
+		t.Fatalf("Host = %q", route.Host)
+	}
+	if route.Upstream.Strategy != "least_conn" {
+		t.Errorf("Strategy = %q, want the lowest-named container's label", route.Upstream.Strategy)
+	}
+	if len(route.Upstream.Servers) != 2 {
+		t.Fatalf("expected 2 servers, got %d", len(route.Upstream.Servers))
+	}
+	// buildRoute sorts containers by name before picking one as primary, so
+	// app-1 comes first regardless of the order Routes() listed them in.
+	if route.Upstream.Servers[0].Address != "app-1" || route.Upstream.Servers[1].Address != "app-2" {
+		t.Errorf("servers not sorted by container name: %+v", route.Upstream.Servers)
+	}
+	if route.Upstream.Servers[0].MaxFails != "3" || route.Upstream.Servers[0].FailTimeout != "30s" {
+		t.Errorf("app-1 server = %+v", route.Upstream.Servers[0])
+	}
+	if route.Upstream.Servers[1].MaxFails != "" || route.Upstream.Servers[1].FailTimeout != "" {
+		t.Errorf("app-2 server = %+v, want no lb labels set", route.Upstream.Servers[1])
+	}
+}
+
+func TestBuildRouteRejectsInvalidStrategy(t *testing.T) {
+	containers := []container.Summary{
+		{
+			Names: []string{"/app"},
+			Labels: map[string]string{
+				"reprox.host":        "example.com",
+				"reprox.lb.strategy": "least_conn; listen 1.2.3.4:1;",
+			},
+		},
+	}
+
+	route := buildRoute("example.com", containers)
+
+	if route.Upstream.Strategy != "" {
+		t.Errorf("Strategy = %q, want empty for a directive-injecting label", route.Upstream.Strategy)
+	}
+}
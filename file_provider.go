@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// FileProvider reads routes from a YAML file, for environments that don't
+// run Docker at all.
+type FileProvider struct {
+	path string
+}
+
+// NewFileProvider returns a Provider that reads routes from the YAML file
+// at path.
+func NewFileProvider(path string) *FileProvider {
+	return &FileProvider{path: path}
+}
+
+type fileConfig struct {
+	Routes []fileRoute `yaml:"routes"`
+}
+
+type fileRoute struct {
+	Host     string   `yaml:"host"`
+	Servers  []string `yaml:"servers"`
+	Strategy string   `yaml:"strategy"`
+}
+
+// Routes re-reads and parses the config file on every call, so it always
+// reflects whatever is currently on disk.
+func (p *FileProvider) Routes(ctx context.Context) ([]Route, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %w", p.path, err)
+	}
+
+	var cfg fileConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", p.path, err)
+	}
+
+	routes := make([]Route, 0, len(cfg.Routes))
+	for _, r := range cfg.Routes {
+		servers := make([]UpstreamServer, len(r.Servers))
+		for i, address := range r.Servers {
+			servers[i] = UpstreamServer{Address: address}
+		}
+		routes = append(routes, Route{
+			Host: r.Host,
+			Upstream: Upstream{
+				Name:     upstreamName(r.Host),
+				Strategy: sanitizeStrategy(r.Strategy),
+				Servers:  servers,
+			},
+		})
+	}
+
+	return routes, nil
+}
+
+// Subscribe watches path via fsnotify and notifies on every write, instead
+// of reprox having to poll the file for changes.
+func (p *FileProvider) Subscribe(ctx context.Context) <-chan struct{} {
+	out := make(chan struct{}, 1)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Println("Error creating file watcher:", err)
+		close(out)
+		return out
+	}
+	if err := watcher.Add(p.path); err != nil {
+		fmt.Println("Error watching", p.path, ":", err)
+		watcher.Close()
+		close(out)
+		return out
+	}
+
+	notify := func() {
+		select {
+		case out <- struct{}{}:
+		default:
+		}
+	}
+	// Notify once on startup so the first route table is available without
+	// waiting for a write.
+	notify()
+
+	go func() {
+		defer watcher.Close()
+		defer close(out)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				notify()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Println("Error watching", p.path, ":", err)
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthCheckInterval is how often each upstream server with a configured
+// health check path is probed. Open-source nginx has no active health
+// checks of its own, so reprox does this in Go and writes the result back
+// into the upstream block as `down`.
+const healthCheckInterval = 10 * time.Second
+
+// RunHealthChecks polls every upstream server that has a
+// reprox.healthcheck.path configured and rewrites+reloads nginx whenever a
+// server's up/down status changes.
+func RunHealthChecks(ctx context.Context, state *State) {
+	httpClient := &http.Client{Timeout: 2 * time.Second}
+
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := checkUpstreams(httpClient, state); err != nil {
+				fmt.Println("Error running health checks:", err)
+			}
+		}
+	}
+}
+
+// checkUpstreams probes every upstream server with a configured health
+// check path against a snapshot of the route table, then patches the
+// resulting Down flags onto whatever the *live* table looks like by the
+// time probing finishes, rather than writing the snapshot back wholesale -
+// probing a few servers can take seconds, long enough for a concurrent
+// reconcile to have added or removed routes in the meantime.
+func checkUpstreams(httpClient *http.Client, state *State) error {
+	routes := state.Routes()
+
+	var updates []HealthUpdate
+	for _, route := range routes {
+		if route.Upstream.HealthCheckPath == "" {
+			continue
+		}
+		for _, server := range route.Upstream.Servers {
+			down := !probe(httpClient, server.Address, route.Upstream.HealthCheckPath)
+			if down != server.Down {
+				updates = append(updates, HealthUpdate{Host: route.Host, Address: server.Address, Down: down})
+			}
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	patched, changed := state.ApplyHealth(updates)
+	if !changed {
+		return nil
+	}
+
+	if err := writeConfig(patched); err != nil {
+		return err
+	}
+	return reloadNginx()
+}
+
+// probe treats any 2xx response from http://address/path as healthy.
+func probe(httpClient *http.Client, address, path string) bool {
+	resp, err := httpClient.Get("http://" + address + path)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// newKubernetesProviderFromEnv builds a KubernetesProvider from whatever
+// cluster config is available: REPROX_KUBECONFIG if set, otherwise the
+// in-cluster config. It returns a nil provider without error when neither
+// is available, so running outside Kubernetes is not an error.
+func newKubernetesProviderFromEnv() (*KubernetesProvider, error) {
+	var (
+		config *rest.Config
+		err    error
+	)
+
+	if kubeconfig := os.Getenv("REPROX_KUBECONFIG"); kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+		if err == rest.ErrNotInCluster {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error building Kubernetes config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Kubernetes client: %w", err)
+	}
+
+	return NewKubernetesProvider(clientset), nil
+}
+
+// KubernetesProvider translates networking.k8s.io/v1 Ingress objects into
+// Routes, watched via a shared informer instead of polling the API server.
+type KubernetesProvider struct {
+	informer cache.SharedIndexInformer
+}
+
+// NewKubernetesProvider returns a Provider backed by Ingress objects in
+// clientset's cluster.
+func NewKubernetesProvider(clientset kubernetes.Interface) *KubernetesProvider {
+	factory := informers.NewSharedInformerFactory(clientset, 10*time.Minute)
+	return &KubernetesProvider{
+		informer: factory.Networking().V1().Ingresses().Informer(),
+	}
+}
+
+// Routes reads every Ingress currently in the informer's local store.
+func (p *KubernetesProvider) Routes(ctx context.Context) ([]Route, error) {
+	var routes []Route
+	for _, obj := range p.informer.GetStore().List() {
+		ingress, ok := obj.(*networkingv1.Ingress)
+		if !ok {
+			continue
+		}
+		routes = append(routes, routesFromIngress(ingress)...)
+	}
+	return routes, nil
+}
+
+// routesFromIngress turns each Ingress rule into a Route. Route has no path
+// concept, so a host with more than one HTTP path (the common "/" + "/api"
+// shape) can't be represented as one upstream without silently routing
+// unrelated path-specific services behind the same nginx location: only the
+// first path per host is kept, and every path after it is rejected with a
+// log line instead of quietly producing a second same-host Route for
+// Aggregator.merge to arbitrarily pick between.
+func routesFromIngress(ingress *networkingv1.Ingress) []Route {
+	var routes []Route
+	seenHosts := map[string]bool{}
+
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service == nil {
+				continue
+			}
+			if seenHosts[rule.Host] {
+				fmt.Printf("Ingress %s/%s: ignoring path %q for host %q, reprox has no path-based routing and already routed this host to another backend\n",
+					ingress.Namespace, ingress.Name, path.Path, rule.Host)
+				continue
+			}
+			seenHosts[rule.Host] = true
+
+			service := path.Backend.Service
+			address := fmt.Sprintf("%s.%s.svc.cluster.local:%d", service.Name, ingress.Namespace, service.Port.Number)
+			routes = append(routes, Route{
+				Host: rule.Host,
+				Upstream: Upstream{
+					Name:    upstreamName(rule.Host),
+					Servers: []UpstreamServer{{Address: address}},
+				},
+			})
+		}
+	}
+	return routes
+}
+
+// Subscribe starts the informer and notifies on every Ingress add, update,
+// or delete.
+func (p *KubernetesProvider) Subscribe(ctx context.Context) <-chan struct{} {
+	out := make(chan struct{}, 1)
+
+	notify := func() {
+		select {
+		case out <- struct{}{}:
+		default:
+		}
+	}
+
+	p.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { notify() },
+		UpdateFunc: func(any, any) { notify() },
+		DeleteFunc: func(any) { notify() },
+	})
+
+	go p.informer.Run(ctx.Done())
+
+	go func() {
+		<-ctx.Done()
+		close(out)
+	}()
+
+	return out
+}
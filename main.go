@@ -8,29 +8,39 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"strings"
-	"sync"
 	"syscall"
 	"text/template"
-	"time"
 
-	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
-	"github.com/robfig/cron/v3"
 )
 
 type Route struct {
-	Host     string
-	Upstream string
+	Host        string
+	Upstream    Upstream
+	Middlewares Middlewares
 }
 
 var (
-	configTemplate = `{{range .}}
+	// configTemplate is split into composable sub-templates (the upstream
+	// block, rate limiting, client certificate verification and IP
+	// allow/deny), so each can be rendered (and tested) independently of the
+	// others instead of one monolithic server block. Basic auth and the
+	// request/response header directives are rendered inline in "routes".
+	configTemplate = `{{define "routes"}}{{range .}}
+{{template "ratelimitzone" .}}{{template "upstreamblock" .}}
 server {
     listen 80;
     listen [::]:80;
     server_name {{.Host}};
-    return 301 https://$host$request_uri;
+
+    location /.well-known/acme-challenge/ {
+        proxy_pass http://{{acmeChallengeAddr}};
+        proxy_set_header Host $host;
+    }
+
+    location / {
+        return 301 https://$host$request_uri;
+    }
 }
 
 server {
@@ -38,8 +48,8 @@ server {
     listen [::]:443 ssl http2;
     server_name {{.Host}};
 
-    ssl_certificate /etc/letsencrypt/live/{{.Host}}/fullchain.pem;
-    ssl_certificate_key /etc/letsencrypt/live/{{.Host}}/privkey.pem;
+    ssl_certificate /var/lib/reprox/certs/live/{{.Host}}/fullchain.pem;
+    ssl_certificate_key /var/lib/reprox/certs/live/{{.Host}}/privkey.pem;
 
     ssl_protocols TLSv1.2 TLSv1.3;
     ssl_ciphers EECDH+AESGCM:EECDH+CHACHA20:EDH+AESGCM;
@@ -48,21 +58,53 @@ server {
     ssl_session_timeout 1h;
     ssl_session_tickets off;
 
+{{template "clientcert" .}}{{template "ipacl" .}}{{if .Middlewares.BasicAuthUsers}}    auth_basic "Restricted";
+    auth_basic_user_file {{htpasswdPath .Host}};
+{{end}}
     location / {
-        proxy_pass http://{{.Upstream}};
+{{template "ratelimit" .}}        proxy_pass http://{{.Upstream.Name}};
         proxy_http_version 1.1;
         proxy_set_header Upgrade $http_upgrade;
         proxy_set_header Connection 'upgrade';
         proxy_set_header Host $host;
         proxy_cache_bypass $http_upgrade;
-    }
+{{range $k := sortedHeaderKeys .Middlewares.RequestHeaders}}        proxy_set_header {{$k}} "{{index $.Middlewares.RequestHeaders $k}}";
+{{end}}{{range $k := sortedHeaderKeys .Middlewares.ResponseHeaders}}        add_header {{$k}} "{{index $.Middlewares.ResponseHeaders $k}}";
+{{end}}    }
 }
-{{end}}`
-	routesMutex  sync.Mutex
-	routes       []Route
-	certbotEmail string = os.Getenv("CERTBOT_EMAIL")
+{{end}}{{end}}
+
+{{define "ratelimitzone"}}{{if .Middlewares.RateLimit}}limit_req_zone $binary_remote_addr zone={{zoneName .Host}}:10m rate={{.Middlewares.RateLimit.RPS}}r/s;
+{{end}}{{end}}
+
+{{define "upstreamblock"}}upstream {{.Upstream.Name}} {
+{{if eq .Upstream.Strategy "least_conn"}}    least_conn;
+{{else if eq .Upstream.Strategy "ip_hash"}}    ip_hash;
+{{else if and .Upstream.Strategy (ne .Upstream.Strategy "round_robin")}}    {{.Upstream.Strategy}};
+{{end}}{{range .Upstream.Servers}}    server {{.Address}}{{if .MaxFails}} max_fails={{.MaxFails}}{{end}}{{if .FailTimeout}} fail_timeout={{.FailTimeout}}{{end}}{{if .Down}} down{{end}};
+{{end}}}
+{{end}}
+
+{{define "ratelimit"}}{{if .Middlewares.RateLimit}}        limit_req zone={{zoneName .Host}} burst={{.Middlewares.RateLimit.Burst}} nodelay;
+{{end}}{{end}}
+
+{{define "clientcert"}}{{if .Middlewares.ClientCertCA}}    ssl_client_certificate {{.Middlewares.ClientCertCA}};
+    ssl_verify_client on;
+{{end}}{{end}}
+
+{{define "ipacl"}}{{range .Middlewares.IPAllow}}    allow {{.}};
+{{end}}{{range .Middlewares.IPDeny}}    deny {{.}};
+{{end}}{{if .Middlewares.IPAllow}}    deny all;
+{{end}}{{end}}`
+	state       = NewState()
+	certManager = NewCertManager(os.Getenv("CERTBOT_EMAIL"))
 )
 
+// defaultAdminAddr is where the admin API listens when REPROX_ADMIN_ADDR is
+// unset. It defaults to localhost so it isn't exposed outside the host
+// without an operator opting in.
+const defaultAdminAddr = "127.0.0.1:9090"
+
 func main() {
 	if err := startNginx(); err != nil {
 		panic(err)
@@ -86,80 +128,99 @@ func main() {
 		cancel()
 	}()
 
-	if err := updateRoutes(ctx, dockerClient); err != nil {
-		fmt.Println("Error updating routes:", err)
-	}
+	go func() {
+		if err := certManager.ServeChallenges(ctx); err != nil {
+			fmt.Println("Error serving ACME challenges:", err)
+		}
+	}()
+	go certManager.RenewLoop(ctx, state.Hosts)
+	go RunHealthChecks(ctx, state)
 
-	c := cron.New()
-	if _, err := c.AddFunc("0 0 * * *", CertbotRun); err != nil {
-		panic(fmt.Sprintf("failed to add cron job: %v", err))
+	providers, err := buildProviders(dockerClient)
+	if err != nil {
+		panic(err)
 	}
+	aggregator := NewAggregator(providers...)
 
+	adminAddr := os.Getenv("REPROX_ADMIN_ADDR")
+	if adminAddr == "" {
+		adminAddr = defaultAdminAddr
+	}
+	admin := NewAdminServer(state, certManager, func(ctx context.Context) error {
+		newRoutes, err := aggregator.merge(ctx)
+		if err != nil {
+			return errors.Join(errors.New("Error merging routes"), err)
+		}
+		return reconcileRoutes(ctx, newRoutes)
+	})
 	go func() {
-		<-time.After(5 * time.Second)
-		CertbotRun()
+		if err := admin.ListenAndServe(ctx, adminAddr); err != nil {
+			fmt.Println("Error serving admin API:", err)
+		}
 	}()
 
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
+	routeUpdates := aggregator.Watch(ctx)
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			if err := updateRoutes(ctx, dockerClient); err != nil {
+		case newRoutes, ok := <-routeUpdates:
+			if !ok {
+				return
+			}
+			if err := reconcileRoutes(ctx, newRoutes); err != nil {
+				state.RecordReconcileError()
 				fmt.Println("Error updating routes:", err)
 			}
 		}
 	}
 }
 
-func CertbotRun() {
-	if err := certbotRun(); err != nil {
-		fmt.Println("Error running certbot:", err)
-	} else {
-		fmt.Println("Certbot run successful")
+// buildProviders assembles the Provider set for this reprox instance: the
+// Docker label provider is always present, with the file and Kubernetes
+// providers layered on top of it when REPROX_CONFIG_FILE or a cluster
+// config is available. Earlier providers win when two disagree on a host.
+func buildProviders(dockerClient *client.Client) ([]Provider, error) {
+	providers := []Provider{NewDockerProvider(dockerClient)}
+
+	if path := os.Getenv("REPROX_CONFIG_FILE"); path != "" {
+		providers = append(providers, NewFileProvider(path))
 	}
-}
 
-func updateRoutes(ctx context.Context, dockerClient *client.Client) error {
-	containers, err := dockerClient.ContainerList(ctx, container.ListOptions{})
+	kubeProvider, err := newKubernetesProviderFromEnv()
 	if err != nil {
-		return errors.Join(errors.New("Error listing containers"), err)
+		return nil, errors.Join(errors.New("Error setting up Kubernetes provider"), err)
 	}
-
-	newRoutes := []Route{}
-	for _, container := range containers {
-		if len(container.Names) == 0 {
-			continue
-		}
-		host, ok := container.Labels["reprox.host"]
-		if !ok || host == "" {
-			continue
-		}
-		newRoutes = append(newRoutes, Route{
-			Host:     host,
-			Upstream: strings.TrimPrefix(container.Names[0], "/"),
-		})
+	if kubeProvider != nil {
+		providers = append(providers, kubeProvider)
 	}
 
-	routesMutex.Lock()
-	defer routesMutex.Unlock()
+	return providers, nil
+}
 
-	if !routesChanged(newRoutes) {
+// reconcileRoutes applies a newly observed route table: it skips work if
+// nothing changed, then ensures certificates, rewrites the nginx config and
+// reloads it.
+func reconcileRoutes(ctx context.Context, newRoutes []Route) error {
+	if !state.Changed(newRoutes) {
 		return nil
 	}
-	routes = newRoutes
+	state.SetRoutes(newRoutes)
+
+	hosts := make([]string, len(newRoutes))
+	for i, route := range newRoutes {
+		hosts[i] = route.Host
+	}
+	certManager.SetHosts(hosts)
 
 	// Ensure certificates are available for all routes
-	for _, route := range routes {
-		if err := ensureCertificate(route.Host); err != nil {
+	for _, route := range newRoutes {
+		if err := certManager.EnsureCertificate(ctx, route.Host); err != nil {
 			return errors.Join(errors.New("Error ensuring certificate"), err)
 		}
 	}
 
-	if err := writeConfig(); err != nil {
+	if err := writeConfig(newRoutes); err != nil {
 		return errors.Join(errors.New("Error writing config"), err)
 	}
 
@@ -167,34 +228,26 @@ func updateRoutes(ctx context.Context, dockerClient *client.Client) error {
 		return errors.Join(errors.New("Error reloading Nginx"), err)
 	}
 
-	// run certbot to request certificates for new routes
-	if err := certbotRun(); err != nil {
-		return errors.Join(errors.New("Error running certbot"), err)
-	}
-
 	return nil
 }
 
-func routesChanged(newRoutes []Route) bool {
-	if len(newRoutes) != len(routes) {
-		return true
-	}
-	for i, route := range newRoutes {
-		if route != routes[i] {
-			return true
-		}
-	}
-	return false
-}
-
-func writeConfig() error {
-	tmpl, err := template.New("nginx").Parse(configTemplate)
+func writeConfig(routes []Route) error {
+	tmpl, err := template.New("nginx").Funcs(template.FuncMap{
+		"sortedHeaderKeys":  sortedHeaderKeys,
+		"zoneName":          zoneName,
+		"htpasswdPath":      htpasswdPath,
+		"acmeChallengeAddr": func() string { return acmeChallengeAddr },
+	}).Parse(configTemplate)
 	if err != nil {
 		return errors.Join(errors.New("Error parsing template"), err)
 	}
 
+	if err := writeHtpasswdFiles(routes); err != nil {
+		return errors.Join(errors.New("Error writing htpasswd files"), err)
+	}
+
 	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, routes); err != nil {
+	if err := tmpl.ExecuteTemplate(&buf, "routes", routes); err != nil {
 		return errors.Join(errors.New("Error executing template"), err)
 	}
 
@@ -205,6 +258,26 @@ func writeConfig() error {
 	return nil
 }
 
+// writeHtpasswdFiles exports each route's basic-auth credentials to the
+// file nginx's auth_basic_user_file points at, so htpasswd-style secrets
+// never have to round-trip through the rendered config itself.
+func writeHtpasswdFiles(routes []Route) error {
+	if err := os.MkdirAll("/etc/nginx/htpasswd", 0700); err != nil {
+		return errors.Join(errors.New("Error creating htpasswd directory"), err)
+	}
+
+	for _, route := range routes {
+		if route.Middlewares.BasicAuthUsers == "" {
+			continue
+		}
+		if err := os.WriteFile(htpasswdPath(route.Host), []byte(route.Middlewares.BasicAuthUsers), 0600); err != nil {
+			return errors.Join(fmt.Errorf("Error writing htpasswd file for %s", route.Host), err)
+		}
+	}
+
+	return nil
+}
+
 func reloadNginx() error {
 	if err := executeCommand("nginx", "-s", "reload"); err != nil {
 		return errors.Join(errors.New("Error reloading Nginx"), err)
@@ -237,52 +310,3 @@ func stopNginx() error {
 	}
 	return nil
 }
-
-func certbotRun() error {
-	if len(routes) == 0 {
-		return errors.New("No routes to request certificates for")
-	}
-
-	for _, route := range routes {
-		if err := executeCommand(
-			"certbot",
-			"--nginx",
-			"--non-interactive",
-			"--agree-tos",
-			"--email", certbotEmail,
-			"--domains", route.Host,
-		); err != nil {
-			return errors.Join(errors.New("Error starting certbot"), err)
-		}
-	}
-
-	return nil
-}
-
-// ensureCertificate ensures that a certificate is available for the given host.
-// If certbot has not been run for the host, this function will generate a new self-signed certificate to make sure the server can start.
-// If there is a certificate, it will do nothing.
-func ensureCertificate(host string) error {
-	if !exists("/etc/letsencrypt/live/"+host+"/fullchain.pem") || !exists("/etc/letsencrypt/live/"+host+"/privkey.pem") {
-		// generate self-signed certificate using openssl that is valid for 1 hour
-		if err := executeCommand(
-			"openssl",
-			"req",
-			"-x509",
-			"-newkey", "rsa:4096",
-			"-keyout", "/etc/letsencrypt/live/"+host+"/privkey.pem",
-			"-out", "/etc/letsencrypt/live/"+host+"/fullchain.pem",
-			"-days", "1",
-			"-nodes",
-			"-subj", "/CN="+host,
-		); err != nil {
-			return errors.Join(errors.New("Error generating self-signed certificate"), err)
-		}
-	}
-	return nil
-}
-
-func exists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
-}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Middlewares holds the per-route reprox.* middleware configuration read
+// from container labels. It is independent of Docker so the nginx
+// rendering can be exercised without a Docker client.
+type Middlewares struct {
+	BasicAuthUsers  string // htpasswd-formatted content for auth_basic_user_file
+	RateLimit       *RateLimit
+	RequestHeaders  map[string]string // rendered as proxy_set_header
+	ResponseHeaders map[string]string // rendered as add_header
+	ClientCertCA    string            // path to a CA bundle for ssl_client_certificate
+	IPAllow         []string
+	IPDeny          []string
+}
+
+// RateLimit configures nginx's limit_req_zone/limit_req for a route.
+type RateLimit struct {
+	RPS   string
+	Burst string
+}
+
+// unsafeTemplateChars matches characters that would let a label value break
+// out of the nginx directive it's interpolated into: quotes end the string
+// early, semicolons and braces start a new directive or block, and a CR/LF
+// starts a new config line entirely.
+var unsafeTemplateChars = regexp.MustCompile(`["';{}\r\n]`)
+
+// headerNamePattern matches a valid HTTP header field-name (RFC 7230 token).
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_` + "`" + `|~-]+$`)
+
+var (
+	rateLimitRPSPattern   = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	rateLimitBurstPattern = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// parseMiddlewares reads the reprox.* labels of a single container into a
+// Middlewares value. Anything that will be interpolated into configTemplate
+// verbatim is validated first and dropped (with a log line) rather than
+// templated, since container labels come from whatever is routed, not just
+// the reprox operator.
+func parseMiddlewares(labels map[string]string) Middlewares {
+	mw := Middlewares{
+		RequestHeaders:  map[string]string{},
+		ResponseHeaders: map[string]string{},
+	}
+
+	if users := labels["reprox.basicauth.users"]; users != "" {
+		mw.BasicAuthUsers = users
+	}
+
+	if rps := labels["reprox.ratelimit.rps"]; rps != "" {
+		burst := labels["reprox.ratelimit.burst"]
+		if rateLimitRPSPattern.MatchString(rps) && rateLimitBurstPattern.MatchString(burst) {
+			mw.RateLimit = &RateLimit{RPS: rps, Burst: burst}
+		} else {
+			fmt.Println("Ignoring invalid reprox.ratelimit.rps/burst labels:", rps, burst)
+		}
+	}
+
+	for key, value := range labels {
+		switch {
+		case strings.HasPrefix(key, "reprox.headers.request."):
+			name := strings.TrimPrefix(key, "reprox.headers.request.")
+			if validHeader(name, value) {
+				mw.RequestHeaders[name] = value
+			} else {
+				fmt.Println("Ignoring invalid reprox.headers.request label:", key)
+			}
+		case strings.HasPrefix(key, "reprox.headers.response."):
+			name := strings.TrimPrefix(key, "reprox.headers.response.")
+			if validHeader(name, value) {
+				mw.ResponseHeaders[name] = value
+			} else {
+				fmt.Println("Ignoring invalid reprox.headers.response label:", key)
+			}
+		}
+	}
+
+	if ca := labels["reprox.tls.clientauth.ca"]; ca != "" {
+		if !unsafeTemplateChars.MatchString(ca) {
+			mw.ClientCertCA = ca
+		} else {
+			fmt.Println("Ignoring invalid reprox.tls.clientauth.ca label:", ca)
+		}
+	}
+
+	if allow := labels["reprox.ipallow"]; allow != "" {
+		mw.IPAllow = splitCIDRList(allow)
+	}
+	if deny := labels["reprox.ipdeny"]; deny != "" {
+		mw.IPDeny = splitCIDRList(deny)
+	}
+
+	return mw
+}
+
+// validHeader reports whether name is a valid HTTP header field-name and
+// value contains none of the characters that would let it escape the
+// proxy_set_header/add_header directive it's rendered into.
+func validHeader(name, value string) bool {
+	return headerNamePattern.MatchString(name) && !unsafeTemplateChars.MatchString(value)
+}
+
+// splitCIDRList parses a comma-separated reprox.ipallow/reprox.ipdeny label
+// into its entries, dropping anything that isn't a valid IP or CIDR instead
+// of templating it into an nginx allow/deny directive unchecked.
+func splitCIDRList(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(item); err != nil && net.ParseIP(item) == nil {
+			fmt.Println("Ignoring invalid IP/CIDR entry:", item)
+			continue
+		}
+		out = append(out, item)
+	}
+	return out
+}
+
+// sortedHeaderKeys returns a header map's keys in a stable order so the
+// generated nginx config doesn't churn between otherwise-identical
+// reconciles.
+func sortedHeaderKeys(headers map[string]string) []string {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// nginxIdentifierReplacer sanitizes a host into characters nginx allows in
+// zone and upstream block names.
+var nginxIdentifierReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+// zoneName derives a unique limit_req_zone name from a host, since nginx
+// zone names can't contain dots.
+func zoneName(host string) string {
+	return "ratelimit_" + nginxIdentifierReplacer.Replace(host)
+}
+
+// htpasswdPath is where the basic-auth credentials for a host are written
+// so nginx's auth_basic_user_file can read them.
+func htpasswdPath(host string) string {
+	return "/etc/nginx/htpasswd/" + host + ".htpasswd"
+}
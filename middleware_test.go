@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMiddlewares(t *testing.T) {
+	labels := map[string]string{
+		"reprox.basicauth.users":        "user:$apr1$hash",
+		"reprox.ratelimit.rps":          "10",
+		"reprox.ratelimit.burst":        "20",
+		"reprox.headers.request.X-Foo":  "bar",
+		"reprox.headers.response.X-Bar": "baz",
+		"reprox.tls.clientauth.ca":      "/etc/reprox/ca.pem",
+		"reprox.ipallow":                "10.0.0.0/8, 192.168.1.1",
+		"reprox.ipdeny":                 "0.0.0.0/0",
+	}
+
+	mw := parseMiddlewares(labels)
+
+	if mw.BasicAuthUsers != "user:$apr1$hash" {
+		t.Errorf("BasicAuthUsers = %q", mw.BasicAuthUsers)
+	}
+	if mw.RateLimit == nil || mw.RateLimit.RPS != "10" || mw.RateLimit.Burst != "20" {
+		t.Errorf("RateLimit = %+v", mw.RateLimit)
+	}
+	if mw.RequestHeaders["X-Foo"] != "bar" {
+		t.Errorf("RequestHeaders = %+v", mw.RequestHeaders)
+	}
+	if mw.ResponseHeaders["X-Bar"] != "baz" {
+		t.Errorf("ResponseHeaders = %+v", mw.ResponseHeaders)
+	}
+	if mw.ClientCertCA != "/etc/reprox/ca.pem" {
+		t.Errorf("ClientCertCA = %q", mw.ClientCertCA)
+	}
+	if !reflect.DeepEqual(mw.IPAllow, []string{"10.0.0.0/8", "192.168.1.1"}) {
+		t.Errorf("IPAllow = %+v", mw.IPAllow)
+	}
+	if !reflect.DeepEqual(mw.IPDeny, []string{"0.0.0.0/0"}) {
+		t.Errorf("IPDeny = %+v", mw.IPDeny)
+	}
+}
+
+func TestParseMiddlewaresRejectsUnsafeValues(t *testing.T) {
+	labels := map[string]string{
+		"reprox.ratelimit.rps":          "10; drop_everything",
+		"reprox.ratelimit.burst":        "20",
+		"reprox.headers.request.X-Evil": "bar\"; }\nserver { listen 1.2.3.4:1;",
+		"reprox.tls.clientauth.ca":      `/etc/reprox/ca.pem"; ssl_verify_client off;`,
+		"reprox.ipallow":                "not-an-ip, 10.0.0.0/8",
+	}
+
+	mw := parseMiddlewares(labels)
+
+	if mw.RateLimit != nil {
+		t.Errorf("expected invalid rate limit labels to be dropped, got %+v", mw.RateLimit)
+	}
+	if _, ok := mw.RequestHeaders["X-Evil"]; ok {
+		t.Errorf("expected header value with unsafe characters to be dropped")
+	}
+	if mw.ClientCertCA != "" {
+		t.Errorf("expected clientauth CA with unsafe characters to be dropped, got %q", mw.ClientCertCA)
+	}
+	if !reflect.DeepEqual(mw.IPAllow, []string{"10.0.0.0/8"}) {
+		t.Errorf("IPAllow = %+v, want only the valid CIDR kept", mw.IPAllow)
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import "context"
+
+// Provider discovers routes from one configuration source — Docker labels,
+// a config file, Kubernetes Ingress objects, or anything else — and
+// notifies when they may have changed instead of making reprox poll it.
+type Provider interface {
+	// Routes returns the provider's current route table.
+	Routes(ctx context.Context) ([]Route, error)
+	// Subscribe returns a channel that receives a value every time the
+	// provider's routes may have changed. It is closed once ctx is done.
+	Subscribe(ctx context.Context) <-chan struct{}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// State is reprox's routing table plus the counters the admin API exposes
+// at /metrics, behind a mutex so HTTP handlers can read it safely while the
+// reconcile loop, cert renewal, and health checks update it concurrently.
+// It replaces the bare routes/routesMutex globals the HTTP handlers had no
+// safe way to reach.
+type State struct {
+	mu     sync.Mutex
+	routes []Route
+
+	reconcileErrors  atomic.Uint64
+	certRenewSuccess atomic.Uint64
+	certRenewFail    atomic.Uint64
+}
+
+// NewState returns an empty State.
+func NewState() *State {
+	return &State{}
+}
+
+// Routes returns a deep copy of the current route table: the slice itself
+// plus every nested slice and map (Upstream.Servers, the Middlewares header
+// maps, IPAllow/IPDeny) so a caller can read or mutate the result without
+// synchronizing with whatever later replaces the live table via SetRoutes.
+func (s *State) Routes() []Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	routes := make([]Route, len(s.routes))
+	for i, route := range s.routes {
+		routes[i] = cloneRoute(route)
+	}
+	return routes
+}
+
+// cloneRoute copies route along with every reference type it holds, so the
+// clone shares no backing storage with the original.
+func cloneRoute(route Route) Route {
+	route.Upstream.Servers = append([]UpstreamServer(nil), route.Upstream.Servers...)
+
+	if route.Middlewares.RateLimit != nil {
+		rateLimit := *route.Middlewares.RateLimit
+		route.Middlewares.RateLimit = &rateLimit
+	}
+
+	route.Middlewares.RequestHeaders = cloneHeaderMap(route.Middlewares.RequestHeaders)
+	route.Middlewares.ResponseHeaders = cloneHeaderMap(route.Middlewares.ResponseHeaders)
+	route.Middlewares.IPAllow = append([]string(nil), route.Middlewares.IPAllow...)
+	route.Middlewares.IPDeny = append([]string(nil), route.Middlewares.IPDeny...)
+
+	return route
+}
+
+func cloneHeaderMap(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	clone := make(map[string]string, len(headers))
+	for k, v := range headers {
+		clone[k] = v
+	}
+	return clone
+}
+
+// SetRoutes replaces the route table.
+func (s *State) SetRoutes(routes []Route) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes = routes
+}
+
+// HealthUpdate is one upstream server's newly observed up/down status, as
+// produced by checkUpstreams.
+type HealthUpdate struct {
+	Host    string
+	Address string
+	Down    bool
+}
+
+// ApplyHealth patches Down flags onto the live route table in place,
+// matched by host+address rather than by the index a probing cycle saw them
+// at. checkUpstreams' probe can take several seconds; patching by identity
+// under the same lock used to read the table means a route change that
+// lands mid-probe (via SetRoutes) is never clobbered by writing back a
+// stale snapshot, and an update for a server that's since been removed is
+// just a harmless no-op instead of resurrecting it. Returns a deep copy of
+// the patched table and whether anything actually changed.
+func (s *State) ApplyHealth(updates []HealthUpdate) ([]Route, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for _, u := range updates {
+		for i := range s.routes {
+			if s.routes[i].Host != u.Host {
+				continue
+			}
+			for j := range s.routes[i].Upstream.Servers {
+				server := &s.routes[i].Upstream.Servers[j]
+				if server.Address != u.Address || server.Down == u.Down {
+					continue
+				}
+				server.Down = u.Down
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil, false
+	}
+
+	routes := make([]Route, len(s.routes))
+	for i, route := range s.routes {
+		routes[i] = cloneRoute(route)
+	}
+	return routes, true
+}
+
+// Hosts returns the Host of every current route, in order.
+func (s *State) Hosts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hosts := make([]string, len(s.routes))
+	for i, route := range s.routes {
+		hosts[i] = route.Host
+	}
+	return hosts
+}
+
+// Changed reports whether newRoutes differs from the current route table.
+func (s *State) Changed(newRoutes []Route) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(newRoutes) != len(s.routes) {
+		return true
+	}
+	for i, route := range newRoutes {
+		if !reflect.DeepEqual(route, s.routes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordReconcileError increments reprox_reconcile_errors_total.
+func (s *State) RecordReconcileError() {
+	s.reconcileErrors.Add(1)
+}
+
+// ReconcileErrors returns the current reprox_reconcile_errors_total value.
+func (s *State) ReconcileErrors() uint64 {
+	return s.reconcileErrors.Load()
+}
+
+// RecordCertRenew increments reprox_cert_renewals_total{result=...}.
+func (s *State) RecordCertRenew(success bool) {
+	if success {
+		s.certRenewSuccess.Add(1)
+	} else {
+		s.certRenewFail.Add(1)
+	}
+}
+
+// CertRenewCounts returns the current success/fail
+// reprox_cert_renewals_total values.
+func (s *State) CertRenewCounts() (success, fail uint64) {
+	return s.certRenewSuccess.Load(), s.certRenewFail.Load()
+}
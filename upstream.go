@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Upstream is the set of backend servers routed to for a single host,
+// rendered as an nginx upstream block. Grouping containers by host here is
+// what lets multiple containers share a host instead of the last one
+// silently winning, as happened when Route carried a single Upstream
+// string.
+type Upstream struct {
+	Name            string
+	Strategy        string // "", "round_robin", "least_conn", "ip_hash", or a verbatim "hash ..." directive
+	HealthCheckPath string
+	Servers         []UpstreamServer
+}
+
+// UpstreamServer is one backend behind an Upstream.
+type UpstreamServer struct {
+	Address     string
+	MaxFails    string
+	FailTimeout string
+	Down        bool // set by the active health check loop
+}
+
+// upstreamName derives a unique nginx upstream block name from a host,
+// since nginx identifiers can't contain dots.
+func upstreamName(host string) string {
+	return "upstream_" + nginxIdentifierReplacer.Replace(host)
+}
+
+var maxFailsPattern = regexp.MustCompile(`^[0-9]+$`)
+var failTimeoutPattern = regexp.MustCompile(`^[0-9]+[smhd]?$`)
+
+// sanitizeStrategy validates a reprox.lb.strategy label against the
+// documented forms the upstreamblock sub-template renders verbatim:
+// round_robin (the default, meaning "emit nothing"), least_conn, ip_hash,
+// or a custom "hash ..." directive (with or without "consistent") free of
+// quotes, semicolons, braces and line breaks. Anything else is dropped
+// rather than templated, since it comes from whatever container is routed,
+// not just the reprox operator.
+func sanitizeStrategy(raw string) string {
+	switch raw {
+	case "", "round_robin", "least_conn", "ip_hash":
+		return raw
+	}
+	if strings.HasPrefix(raw, "hash ") && !unsafeTemplateChars.MatchString(raw) {
+		return raw
+	}
+	fmt.Println("Ignoring invalid reprox.lb.strategy label:", raw)
+	return ""
+}
+
+// sanitizeMaxFails validates a reprox.lb.maxfails label, which is
+// templated verbatim into an upstream server's max_fails=... directive.
+func sanitizeMaxFails(raw string) string {
+	if raw == "" || maxFailsPattern.MatchString(raw) {
+		return raw
+	}
+	fmt.Println("Ignoring invalid reprox.lb.maxfails label:", raw)
+	return ""
+}
+
+// sanitizeFailTimeout validates a reprox.lb.failtimeout label, which is
+// templated verbatim into an upstream server's fail_timeout=... directive.
+func sanitizeFailTimeout(raw string) string {
+	if raw == "" || failTimeoutPattern.MatchString(raw) {
+		return raw
+	}
+	fmt.Println("Ignoring invalid reprox.lb.failtimeout label:", raw)
+	return ""
+}